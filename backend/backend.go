@@ -0,0 +1,68 @@
+// Package backend defines the storage abstraction that the HTTP layer talks
+// to, independent of which system actually persists Terraform state.
+package backend
+
+import (
+	"context"
+	"errors"
+)
+
+// Backend reads and writes the raw Terraform state blob for a named
+// workspace. ctx is cancelled when the in-flight HTTP request is, and
+// implementations backed by a network connection should give up promptly
+// when it is.
+type Backend interface {
+	Get(ctx context.Context, name string) ([]byte, error)
+	Update(ctx context.Context, name string, state []byte) error
+	Delete(ctx context.Context, name string) error
+}
+
+// Locker guards a named workspace with Terraform's lock/unlock protocol.
+type Locker interface {
+	Lock(ctx context.Context, name string, lockinfo []byte) (alreadyLocked bool, newlockinfo []byte, err error)
+	Unlock(ctx context.Context, name string) error
+	GetLock(ctx context.Context, name string) ([]byte, error)
+}
+
+// Pinger is optionally implemented by a Backend whose health depends on a
+// long-lived connection. The /healthz handler reports 503 while Ping
+// returns an error.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Closer is optionally implemented by a Backend that holds a resource (such
+// as a persistent connection) needing explicit teardown. Server.Close calls
+// it, if present, when the server is shut down.
+type Closer interface {
+	Close()
+}
+
+// Lister is optionally implemented by a Backend that organizes workspaces
+// under project namespaces and can enumerate them, e.g. to serve a
+// directory-style listing over HTTP.
+type Lister interface {
+	// Tree returns every known workspace name grouped by project.
+	Tree(ctx context.Context) (map[string][]string, error)
+	// ListProject returns the names of workspaces under project.
+	ListProject(ctx context.Context, project string) ([]string, error)
+}
+
+// LockInfo mirrors the subset of Terraform's state.LockInfo JSON that the
+// HTTP layer needs in order to validate lock ownership.
+type LockInfo struct {
+	ID string `json:"ID"`
+}
+
+// Sentinel errors returned by every Backend/Locker implementation. The HTTP
+// layer switches on these directly, so implementations must return them
+// verbatim rather than wrapping them.
+var (
+	ErrConn     = errors.New("tf-zk-backend: cannot connect to backend")
+	ErrNotExist = errors.New("tf-zk-backend: state does not exist")
+	ErrCreate   = errors.New("tf-zk-backend: cannot create state")
+	ErrUpdate   = errors.New("tf-zk-backend: cannot update state")
+	ErrDelete   = errors.New("tf-zk-backend: cannot delete state")
+	ErrRead     = errors.New("tf-zk-backend: cannot read state")
+	ErrWrite    = errors.New("tf-zk-backend: cannot write state")
+)
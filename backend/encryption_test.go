@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAESGCMEncrypterRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	encrypter, err := NewAESGCMEncrypter(key)
+	if err != nil {
+		t.Fatalf("NewAESGCMEncrypter: %v", err)
+	}
+
+	plaintext := []byte(`{"version":4}`)
+
+	ciphertext, err := encrypter.Encrypt(plaintext)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Fatalf("ciphertext contains plaintext")
+	}
+
+	got, err := encrypter.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("Decrypt() = %q, want %q", got, plaintext)
+	}
+}
+
+func TestNewAESGCMEncrypterRejectsBadKeyLength(t *testing.T) {
+	if _, err := NewAESGCMEncrypter([]byte("too-short")); err == nil {
+		t.Fatal("expected an error for a non-32-byte key")
+	}
+}
+
+func TestEncryptDecryptStateRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	encrypter, err := NewAESGCMEncrypter(key)
+	if err != nil {
+		t.Fatalf("NewAESGCMEncrypter: %v", err)
+	}
+
+	plaintext := []byte(`{"version":4}`)
+
+	envelope, err := EncryptState(encrypter, plaintext)
+	if err != nil {
+		t.Fatalf("EncryptState: %v", err)
+	}
+
+	got, err := DecryptState(encrypter, envelope)
+	if err != nil {
+		t.Fatalf("DecryptState: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("DecryptState() = %q, want %q", got, plaintext)
+	}
+}
+
+func TestDecryptStatePassesThroughLegacyPlaintext(t *testing.T) {
+	legacy := []byte(`{"version":4,"serial":1}`)
+
+	got, err := DecryptState(nil, legacy)
+	if err != nil {
+		t.Fatalf("DecryptState: %v", err)
+	}
+	if !bytes.Equal(got, legacy) {
+		t.Fatalf("DecryptState() = %q, want %q", got, legacy)
+	}
+}
+
+func TestDecryptStateRejectsEncryptedDataWithNoEncrypter(t *testing.T) {
+	key := bytes.Repeat([]byte("k"), 32)
+	encrypter, err := NewAESGCMEncrypter(key)
+	if err != nil {
+		t.Fatalf("NewAESGCMEncrypter: %v", err)
+	}
+
+	envelope, err := EncryptState(encrypter, []byte("state"))
+	if err != nil {
+		t.Fatalf("EncryptState: %v", err)
+	}
+
+	if _, err := DecryptState(nil, envelope); err == nil {
+		t.Fatal("expected an error decrypting without an encrypter configured")
+	}
+}
@@ -0,0 +1,273 @@
+// Package local implements backend.Backend and backend.Locker on top of the
+// local filesystem, for running without a Zookeeper (or other) cluster.
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+)
+
+// Store keeps each workspace's state and lock as a file under Dir.
+type Store struct {
+	Dir    string
+	logger *logrus.Logger
+}
+
+// New returns a Store rooted at dir, creating it if it does not exist.
+func New(dir string, logger *logrus.Logger) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		Dir:    dir,
+		logger: logger,
+	}, nil
+}
+
+// resolvePath joins name+ext onto Dir and rejects the result if name (e.g. a
+// "../../etc/passwd" project/workspace segment from the HTTP route) resolves
+// outside of Dir.
+func (store *Store) resolvePath(name, ext string) (string, error) {
+	path := filepath.Join(store.Dir, name+ext)
+
+	rel, err := filepath.Rel(store.Dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		store.logger.WithFields(logrus.Fields{
+			"name": name,
+		}).Error("Workspace name escapes the state directory")
+		return "", backend.ErrNotExist
+	}
+	return path, nil
+}
+
+func (store *Store) statePath(name string) (string, error) {
+	return store.resolvePath(name, ".tfstate")
+}
+
+func (store *Store) lockPath(name string) (string, error) {
+	return store.resolvePath(name, ".lock")
+}
+
+// Ping reports whether Dir is still reachable.
+func (store *Store) Ping(ctx context.Context) error {
+	if _, err := os.Stat(store.Dir); err != nil {
+		return backend.ErrConn
+	}
+	return nil
+}
+
+func (store *Store) Get(ctx context.Context, name string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	path, err := store.statePath(name)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"path": path,
+	})
+	ctxLog.Debug("Get state file")
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		ctxLog.Infof("Terraform state retrieved")
+		return data, nil
+	case os.IsNotExist(err):
+		ctxLog.Error("Terraform state does not exist")
+		return []byte{}, backend.ErrNotExist
+	default:
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Terraform state cannot be retrieved")
+		return []byte{}, backend.ErrRead
+	}
+}
+
+func (store *Store) Update(ctx context.Context, name string, state []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path, err := store.statePath(name)
+	if err != nil {
+		return err
+	}
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"path": path,
+	})
+	ctxLog.Debug("Update state file")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot create state directory")
+		return backend.ErrWrite
+	}
+
+	if err := ioutil.WriteFile(path, state, 0o644); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot write state file")
+		return backend.ErrWrite
+	}
+
+	ctxLog.Info("Terraform state updated")
+	return nil
+}
+
+func (store *Store) Delete(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path, err := store.statePath(name)
+	if err != nil {
+		return err
+	}
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"path": path,
+	})
+	ctxLog.Debug("Delete state file")
+
+	err = os.Remove(path)
+	switch {
+	case err == nil:
+		ctxLog.Info("Terraform state deleted")
+		return nil
+	case os.IsNotExist(err):
+		ctxLog.Error("Terraform state does not exist")
+		return backend.ErrNotExist
+	default:
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot delete state file")
+		return backend.ErrDelete
+	}
+}
+
+func (store *Store) GetLock(ctx context.Context, name string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	path, err := store.lockPath(name)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"path": path,
+	})
+	ctxLog.Debug("Get lock file")
+
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		ctxLog.Debug("Terraform lock retrieved")
+		return data, nil
+	case os.IsNotExist(err):
+		ctxLog.Error("Terraform lock does not exist")
+		return []byte{}, backend.ErrNotExist
+	default:
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Terraform lock cannot be retrieved")
+		return []byte{}, backend.ErrRead
+	}
+}
+
+func (store *Store) Lock(ctx context.Context, name string, lockinfo []byte) (alreadyLocked bool, newlockinfo []byte, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, []byte{}, err
+	}
+
+	path, err := store.lockPath(name)
+	if err != nil {
+		return false, []byte{}, err
+	}
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"path": path,
+	})
+	ctxLog.Debug("Lock state file")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot create lock directory")
+		return false, []byte{}, backend.ErrCreate
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		if os.IsExist(err) {
+			existingLock, readErr := ioutil.ReadFile(path)
+			if readErr != nil {
+				ctxLog.Error("Terraform lock state cannot be retrieved")
+				return false, []byte{}, backend.ErrRead
+			}
+			ctxLog.Info("Terraform lock exists")
+			return true, existingLock, nil
+		}
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot create lock file")
+		return false, []byte{}, backend.ErrCreate
+	}
+	defer f.Close()
+
+	if _, err := f.Write(lockinfo); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot write lock file")
+		return false, []byte{}, backend.ErrCreate
+	}
+
+	ctxLog.Info("Terraform lock created")
+	return false, lockinfo, nil
+}
+
+func (store *Store) Unlock(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	path, err := store.lockPath(name)
+	if err != nil {
+		return err
+	}
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"path": path,
+	})
+	ctxLog.Debug("Unlock state file")
+
+	err = os.Remove(path)
+	switch {
+	case err == nil:
+		ctxLog.Info("Terraform state unlocked")
+		return nil
+	case os.IsNotExist(err):
+		ctxLog.Error("Terraform lockinfo does not exist")
+		return backend.ErrNotExist
+	default:
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot delete lock file")
+		return backend.ErrDelete
+	}
+}
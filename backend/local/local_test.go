@@ -0,0 +1,104 @@
+package local
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := New(t.TempDir(), logrus.New())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return store
+}
+
+func TestStoreGetUpdateDeleteRoundTrip(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "ws"); err != backend.ErrNotExist {
+		t.Fatalf("Get() before Update = %v, want ErrNotExist", err)
+	}
+
+	state := []byte(`{"version":4}`)
+	if err := store.Update(ctx, "ws", state); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	got, err := store.Get(ctx, "ws")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(got) != string(state) {
+		t.Fatalf("Get() = %q, want %q", got, state)
+	}
+
+	if err := store.Delete(ctx, "ws"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if _, err := store.Get(ctx, "ws"); err != backend.ErrNotExist {
+		t.Fatalf("Get() after Delete = %v, want ErrNotExist", err)
+	}
+}
+
+func TestStoreLockUnlockRoundTrip(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	lockinfo := []byte(`{"ID":"abc"}`)
+	alreadyLocked, got, err := store.Lock(ctx, "ws", lockinfo)
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if alreadyLocked {
+		t.Fatal("Lock() reported alreadyLocked on first call")
+	}
+	if string(got) != string(lockinfo) {
+		t.Fatalf("Lock() = %q, want %q", got, lockinfo)
+	}
+
+	alreadyLocked, got, err = store.Lock(ctx, "ws", []byte(`{"ID":"other"}`))
+	if err != nil {
+		t.Fatalf("Lock (second): %v", err)
+	}
+	if !alreadyLocked {
+		t.Fatal("Lock() did not report alreadyLocked on second call")
+	}
+	if string(got) != string(lockinfo) {
+		t.Fatalf("Lock() (second) = %q, want existing %q", got, lockinfo)
+	}
+
+	if err := store.Unlock(ctx, "ws"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	if _, err := store.GetLock(ctx, "ws"); err != backend.ErrNotExist {
+		t.Fatalf("GetLock() after Unlock = %v, want ErrNotExist", err)
+	}
+}
+
+func TestStoreRejectsPathTraversal(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	cases := []string{"../outside", "a/../../outside", "../../../etc/passwd"}
+	for _, name := range cases {
+		if _, err := store.Get(ctx, name); err != backend.ErrNotExist {
+			t.Errorf("Get(%q) = %v, want ErrNotExist", name, err)
+		}
+		if err := store.Update(ctx, name, []byte("x")); err != backend.ErrNotExist {
+			t.Errorf("Update(%q) = %v, want ErrNotExist", name, err)
+		}
+		if _, _, err := store.Lock(ctx, name, []byte("x")); err != backend.ErrNotExist {
+			t.Errorf("Lock(%q) = %v, want ErrNotExist", name, err)
+		}
+	}
+}
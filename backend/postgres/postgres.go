@@ -0,0 +1,221 @@
+// Package postgres implements backend.Backend and backend.Locker on top of
+// Postgres, storing each workspace's state and lock as a row.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS tfstate (
+	name  TEXT PRIMARY KEY,
+	state BYTEA NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tfstate_locks (
+	name     TEXT PRIMARY KEY,
+	lockinfo BYTEA NOT NULL
+);
+`
+
+// Store keeps each workspace's state and lock as a row in Postgres.
+type Store struct {
+	db     *sql.DB
+	logger *logrus.Logger
+}
+
+// New opens a connection pool to the Postgres instance at dsn and ensures
+// the backing tables exist.
+func New(dsn string, logger *logrus.Logger) (*Store, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		db:     db,
+		logger: logger,
+	}, nil
+}
+
+// Ping reports whether the connection pool can still reach Postgres.
+func (store *Store) Ping(ctx context.Context) error {
+	if err := store.db.PingContext(ctx); err != nil {
+		return backend.ErrConn
+	}
+	return nil
+}
+
+func (store *Store) Get(ctx context.Context, name string) ([]byte, error) {
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"name": name,
+	})
+	ctxLog.Debug("Get state row")
+
+	var state []byte
+	err := store.db.QueryRowContext(ctx, `SELECT state FROM tfstate WHERE name = $1`, name).Scan(&state)
+	switch err {
+	case nil:
+		ctxLog.Infof("Terraform state retrieved")
+		return state, nil
+	case sql.ErrNoRows:
+		ctxLog.Error("Terraform state does not exist")
+		return []byte{}, backend.ErrNotExist
+	default:
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Terraform state cannot be retrieved")
+		return []byte{}, backend.ErrRead
+	}
+}
+
+func (store *Store) Update(ctx context.Context, name string, state []byte) error {
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"name": name,
+	})
+	ctxLog.Debug("Update state row")
+
+	_, err := store.db.ExecContext(ctx, `
+		INSERT INTO tfstate (name, state) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET state = EXCLUDED.state
+	`, name, state)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot upsert state row")
+		return backend.ErrWrite
+	}
+
+	ctxLog.Info("Terraform state updated")
+	return nil
+}
+
+func (store *Store) Delete(ctx context.Context, name string) error {
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"name": name,
+	})
+	ctxLog.Debug("Delete state row")
+
+	res, err := store.db.ExecContext(ctx, `DELETE FROM tfstate WHERE name = $1`, name)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot delete state row")
+		return backend.ErrDelete
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot determine rows affected")
+		return backend.ErrDelete
+	}
+	if affected == 0 {
+		ctxLog.Error("Terraform state does not exist")
+		return backend.ErrNotExist
+	}
+
+	ctxLog.Info("Terraform state deleted")
+	return nil
+}
+
+func (store *Store) GetLock(ctx context.Context, name string) ([]byte, error) {
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"name": name,
+	})
+	ctxLog.Debug("Get lock row")
+
+	var lockinfo []byte
+	err := store.db.QueryRowContext(ctx, `SELECT lockinfo FROM tfstate_locks WHERE name = $1`, name).Scan(&lockinfo)
+	switch err {
+	case nil:
+		ctxLog.Debug("Terraform lock retrieved")
+		return lockinfo, nil
+	case sql.ErrNoRows:
+		ctxLog.Error("Terraform lock does not exist")
+		return []byte{}, backend.ErrNotExist
+	default:
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Terraform lock cannot be retrieved")
+		return []byte{}, backend.ErrRead
+	}
+}
+
+func (store *Store) Lock(ctx context.Context, name string, lockinfo []byte) (alreadyLocked bool, newlockinfo []byte, err error) {
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"name": name,
+	})
+	ctxLog.Debug("Lock state row")
+
+	_, err = store.db.ExecContext(ctx, `
+		INSERT INTO tfstate_locks (name, lockinfo) VALUES ($1, $2)
+		ON CONFLICT (name) DO NOTHING
+	`, name, lockinfo)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot insert lock row")
+		return false, []byte{}, backend.ErrCreate
+	}
+
+	var existingLock []byte
+	if err := store.db.QueryRowContext(ctx, `SELECT lockinfo FROM tfstate_locks WHERE name = $1`, name).Scan(&existingLock); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot read back lock row")
+		return false, []byte{}, backend.ErrRead
+	}
+
+	if string(existingLock) != string(lockinfo) {
+		ctxLog.Info("Terraform lock exists")
+		return true, existingLock, nil
+	}
+
+	ctxLog.Info("Terraform lock created")
+	return false, lockinfo, nil
+}
+
+func (store *Store) Unlock(ctx context.Context, name string) error {
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"name": name,
+	})
+	ctxLog.Debug("Unlock state row")
+
+	res, err := store.db.ExecContext(ctx, `DELETE FROM tfstate_locks WHERE name = $1`, name)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot delete lock row")
+		return backend.ErrDelete
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot determine rows affected")
+		return backend.ErrDelete
+	}
+	if affected == 0 {
+		ctxLog.Error("Terraform lockinfo does not exist")
+		return backend.ErrNotExist
+	}
+
+	ctxLog.Info("Terraform state unlocked")
+	return nil
+}
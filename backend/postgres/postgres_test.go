@@ -0,0 +1,96 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+)
+
+// newTestStore connects to the Postgres instance named by TF_ZK_BACKEND_TEST_DSN,
+// skipping the test when it is not set since these tests need a real database.
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	dsn := os.Getenv("TF_ZK_BACKEND_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TF_ZK_BACKEND_TEST_DSN not set, skipping test that needs a real Postgres instance")
+	}
+
+	store, err := New(dsn, logrus.New())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return store
+}
+
+func TestStoreGetUpdateDeleteRoundTrip(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	defer store.Delete(ctx, "ws")
+
+	if _, err := store.Get(ctx, "ws"); err != backend.ErrNotExist {
+		t.Fatalf("Get() before Update = %v, want ErrNotExist", err)
+	}
+
+	state := []byte(`{"version":4}`)
+	if err := store.Update(ctx, "ws", state); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	got, err := store.Get(ctx, "ws")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(got) != string(state) {
+		t.Fatalf("Get() = %q, want %q", got, state)
+	}
+
+	if err := store.Delete(ctx, "ws"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	if _, err := store.Get(ctx, "ws"); err != backend.ErrNotExist {
+		t.Fatalf("Get() after Delete = %v, want ErrNotExist", err)
+	}
+}
+
+func TestStoreLockUnlockRoundTrip(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	defer store.Unlock(ctx, "ws")
+
+	lockinfo := []byte(`{"ID":"abc"}`)
+	alreadyLocked, got, err := store.Lock(ctx, "ws", lockinfo)
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if alreadyLocked {
+		t.Fatal("Lock() reported alreadyLocked on first call")
+	}
+	if string(got) != string(lockinfo) {
+		t.Fatalf("Lock() = %q, want %q", got, lockinfo)
+	}
+
+	alreadyLocked, got, err = store.Lock(ctx, "ws", []byte(`{"ID":"other"}`))
+	if err != nil {
+		t.Fatalf("Lock (second): %v", err)
+	}
+	if !alreadyLocked {
+		t.Fatal("Lock() did not report alreadyLocked on second call")
+	}
+	if string(got) != string(lockinfo) {
+		t.Fatalf("Lock() (second) = %q, want existing %q", got, lockinfo)
+	}
+
+	if err := store.Unlock(ctx, "ws"); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+
+	if _, err := store.GetLock(ctx, "ws"); err != backend.ErrNotExist {
+		t.Fatalf("GetLock() after Unlock = %v, want ErrNotExist", err)
+	}
+}
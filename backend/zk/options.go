@@ -0,0 +1,68 @@
+package zk
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+)
+
+// Option configures a Store created by New.
+type Option func(*Store)
+
+// WithHosts sets the Zookeeper ensemble to connect to.
+func WithHosts(hosts []string) Option {
+	return func(store *Store) {
+		store.Zks = hosts
+	}
+}
+
+// WithSessionTimeout sets the timeout used when establishing a Zookeeper
+// session. Defaults to one second.
+func WithSessionTimeout(timeout time.Duration) Option {
+	return func(store *Store) {
+		store.sessionTimeout = timeout
+	}
+}
+
+// WithLogger sets the logger the Store reports znode operations to.
+func WithLogger(logger *logrus.Logger) Option {
+	return func(store *Store) {
+		store.logger = logger
+	}
+}
+
+// WithStatePrefix sets the znode path under which every workspace is
+// stored, as "<prefix>/<project>/<name>". Defaults to "", i.e. workspaces
+// are stored directly under the zk root.
+func WithStatePrefix(prefix string) Option {
+	return func(store *Store) {
+		store.prefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithEncrypter enables envelope encryption of state (but not lock)
+// payloads using encrypter, e.g. a KMS-backed implementation.
+func WithEncrypter(encrypter backend.Encrypter) Option {
+	return func(store *Store) {
+		store.encrypter = encrypter
+	}
+}
+
+// WithEncryptionKey is a convenience over WithEncrypter for a raw
+// AES-256-GCM key. key must be 32 bytes; an invalid key disables
+// encryption and is logged as an error by New.
+func WithEncryptionKey(key []byte) Option {
+	return func(store *Store) {
+		encrypter, err := backend.NewAESGCMEncrypter(key)
+		if err != nil {
+			store.logger.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Error("Cannot initialize state encryption, writing state in cleartext")
+			return
+		}
+		store.encrypter = encrypter
+	}
+}
@@ -0,0 +1,638 @@
+// Package zk implements backend.Backend and backend.Locker on top of
+// Zookeeper, storing each workspace's state and lock as a znode.
+package zk
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/sirupsen/logrus"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+)
+
+// Store manages terraform state using zookeeper, holding a single
+// long-lived session shared by every call.
+type Store struct {
+	Zks            []string
+	sessionTimeout time.Duration
+	logger         *logrus.Logger
+	encrypter      backend.Encrypter
+	prefix         string
+
+	mu    sync.RWMutex
+	conn  *zk.Conn
+	state zk.State
+}
+
+// znodePath returns the path a workspace's state is stored at, under the
+// configured prefix.
+func (store *Store) znodePath(name string) string {
+	return store.prefix + "/" + name
+}
+
+// lockPath returns the path a workspace's lock is stored at, as a child of
+// its state znode.
+func (store *Store) lockPath(name string) string {
+	return store.znodePath(name) + "/.lock"
+}
+
+// ensureParents walks each segment of path but the last, creating any
+// znode that does not yet exist so that a workspace nested under
+// "<project>/<name>" (or its lock under ".../.lock") can be created without
+// Zookeeper rejecting it for a missing parent.
+func ensureParents(conn *zk.Conn, path string) error {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	current := ""
+	for _, segment := range segments[:len(segments)-1] {
+		current += "/" + segment
+		exists, _, err := conn.Exists(current)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := conn.Create(current, []byte{}, int32(0), zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// New returns a Store that connects to the given Zookeeper ensemble,
+// configured by opts. Defaults to a 1-second session timeout and a
+// logrus.Logger with logrus defaults. Call Connect before using the Store.
+func New(opts ...Option) *Store {
+	store := &Store{
+		sessionTimeout: time.Second,
+		logger:         logrus.New(),
+	}
+
+	for _, opt := range opts {
+		opt(store)
+	}
+
+	return store
+}
+
+// Connect establishes the Zookeeper session used by every subsequent call
+// and starts a background goroutine that logs session-state transitions and
+// re-establishes the session with exponential backoff if it expires. The
+// goroutine runs until ctx is cancelled.
+func (store *Store) Connect(ctx context.Context) error {
+	return store.connect(ctx, baseReconnectBackoff)
+}
+
+func (store *Store) connect(ctx context.Context, backoff time.Duration) error {
+	conn, events, err := zk.Connect(store.Zks, store.sessionTimeout)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Err() != nil {
+		// ctx was cancelled (e.g. Server.Close) while zk.Connect was in
+		// flight: don't install a session nothing will ever close.
+		conn.Close()
+		return ctx.Err()
+	}
+
+	store.mu.Lock()
+	previous := store.conn
+	store.conn = conn
+	store.mu.Unlock()
+
+	// previous is non-nil on a reconnect: close it rather than leaking its
+	// socket and goroutines now that store.conn no longer references it.
+	if previous != nil {
+		previous.Close()
+	}
+
+	go store.watch(ctx, events, backoff)
+	return nil
+}
+
+// Close closes the current Zookeeper session, if any, stopping its
+// background goroutines. It does not cancel the context passed to Connect;
+// callers embedding Store directly (rather than through Server) should
+// cancel that context first so the watch goroutine also stops.
+func (store *Store) Close() {
+	store.mu.Lock()
+	conn := store.conn
+	store.conn = nil
+	store.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+const (
+	baseReconnectBackoff = time.Second
+	maxReconnectBackoff  = 30 * time.Second
+)
+
+func (store *Store) watch(ctx context.Context, events <-chan zk.Event, backoff time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type != zk.EventSession {
+				continue
+			}
+
+			store.mu.Lock()
+			store.state = ev.State
+			store.mu.Unlock()
+
+			switch ev.State {
+			case zk.StateHasSession:
+				store.logger.Info("Zookeeper session established")
+				backoff = baseReconnectBackoff
+			case zk.StateDisconnected:
+				store.logger.Warn("Zookeeper session disconnected")
+			case zk.StateExpired:
+				store.reconnect(ctx, backoff)
+				return
+			}
+		}
+	}
+}
+
+// reconnect retries connect with exponential backoff, starting at backoff,
+// until a new session is established or ctx is cancelled. Each failed
+// attempt doubles the wait (capped at maxReconnectBackoff) before retrying,
+// rather than giving up after the first attempt; the watch goroutine
+// watching the new session resets back to baseReconnectBackoff once
+// StateHasSession fires, so a later, unrelated expiry does not inherit a
+// stretched-out backoff from this outage.
+func (store *Store) reconnect(ctx context.Context, backoff time.Duration) {
+	for {
+		store.logger.WithFields(logrus.Fields{
+			"backoff": backoff.String(),
+		}).Warn("Zookeeper session expired, reconnecting")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := store.connect(ctx, backoff); err != nil {
+			store.logger.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Error("Cannot reconnect to zk, retrying")
+
+			backoff = growBackoff(backoff)
+			continue
+		}
+		return
+	}
+}
+
+// growBackoff doubles backoff, capped at maxReconnectBackoff.
+func growBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxReconnectBackoff {
+		backoff = maxReconnectBackoff
+	}
+	return backoff
+}
+
+// Ping reports whether the Store currently holds a live Zookeeper session.
+func (store *Store) Ping(ctx context.Context) error {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if store.conn == nil || store.state != zk.StateHasSession {
+		return backend.ErrConn
+	}
+	return nil
+}
+
+func (store *Store) getConn() (*zk.Conn, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if store.conn == nil {
+		return nil, backend.ErrConn
+	}
+	return store.conn, nil
+}
+
+func (store *Store) Get(ctx context.Context, name string) ([]byte, error) {
+	znode := store.znodePath(name)
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"znode": znode,
+	})
+	ctxLog.Debug("Get znode state")
+
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		ctxLog.Error("No active zk session")
+		return []byte{}, backend.ErrConn
+	}
+
+	data, _, err := conn.Get(znode)
+	if err != nil {
+		ctxLog = ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		})
+	}
+	switch err {
+	case nil:
+		ctxLog.Infof("Terraform state retrieved")
+		plaintext, decErr := backend.DecryptState(store.encrypter, data)
+		if decErr != nil {
+			ctxLog.WithFields(logrus.Fields{
+				"reason": decErr.Error(),
+			}).Error("Cannot decrypt terraform state")
+			return []byte{}, backend.ErrRead
+		}
+		return plaintext, nil
+	case zk.ErrNoNode:
+		ctxLog.Error("Terraform state does not exist")
+		return data, backend.ErrNotExist
+	default:
+		ctxLog.Error("Terraform state cannot be retrieved")
+		return data, backend.ErrRead
+	}
+}
+
+func (store *Store) Update(ctx context.Context, name string, state []byte) error {
+	znode := store.znodePath(name)
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"znode": znode,
+	})
+	ctxLog.Debug("Update znode state")
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		ctxLog.Error("No active zk session")
+		return backend.ErrConn
+	}
+
+	payload := state
+	if store.encrypter != nil {
+		payload, err = backend.EncryptState(store.encrypter, state)
+		if err != nil {
+			ctxLog.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Error("Cannot encrypt terraform state")
+			return backend.ErrWrite
+		}
+	}
+
+	exists, stat, err := conn.Exists(znode)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot check znode's existance")
+		return backend.ErrRead
+	}
+
+	if !exists {
+		if err := ensureParents(conn, znode); err != nil {
+			ctxLog.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Error("Cannot create parent znodes")
+			return backend.ErrCreate
+		}
+
+		_, err = conn.Create(znode, payload, int32(0), zk.WorldACL(zk.PermAll))
+		if err != nil {
+			ctxLog.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Error("Cannot create znode")
+			return backend.ErrCreate
+		}
+		ctxLog.Info("Terraform state created")
+		return nil
+	}
+
+	children, _, err := conn.Children(znode)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot check znode's children")
+		return backend.ErrRead
+	}
+	nested := 0
+	for _, child := range children {
+		// The workspace's own lock lives at ".../.lock"; it is not a
+		// nested workspace.
+		if child != ".lock" {
+			nested++
+		}
+	}
+	if nested > 0 {
+		// znode is a placeholder ensureParents created as the parent of nested
+		// workspaces, not a real flat state: writing here would bury those
+		// workspaces behind this state instead of being stored alongside them.
+		ctxLog.Error("Refusing to write flat state over a project with nested workspaces")
+		return backend.ErrWrite
+	}
+
+	ctxLog = ctxLog.WithFields(logrus.Fields{
+		"znode":        znode,
+		"stat_version": stat.Version,
+	})
+
+	ctxLog.Info("Update terraform state")
+
+	_, err = conn.Set(znode, payload, stat.Version)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot update znode")
+		return backend.ErrUpdate
+	}
+	ctxLog.Info("Terraform state updated")
+	return nil
+}
+
+func (store *Store) Delete(ctx context.Context, name string) error {
+	znode := store.znodePath(name)
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"znode": znode,
+	})
+	ctxLog.Debug("Delete znode state")
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		ctxLog.Error("No active zk session")
+		return backend.ErrConn
+	}
+
+	exists, stat, err := conn.Exists(znode)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot check znode's existance")
+		return backend.ErrRead
+	}
+
+	if !exists {
+		ctxLog.Error("Terraform state does not exist")
+		return backend.ErrNotExist
+	}
+
+	ctxLog = ctxLog.WithFields(logrus.Fields{
+		"znode":        znode,
+		"stat_version": stat.Version,
+	})
+
+	ctxLog.Info("Delete terraform state")
+
+	if err := conn.Delete(znode, stat.Version); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot delete znode")
+		return backend.ErrDelete
+	}
+
+	ctxLog.Info("Terraform state deleted")
+	return nil
+}
+
+// GetLock returns the raw lock payload currently held for name, as stored by
+// Lock. Callers that only need the lock ID should decode it as LockInfo.
+func (store *Store) GetLock(ctx context.Context, name string) ([]byte, error) {
+	znode := store.lockPath(name)
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"znode": znode,
+	})
+	ctxLog.Debug("Get lock znode state")
+
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		ctxLog.Error("No active zk session")
+		return []byte{}, backend.ErrConn
+	}
+
+	data, _, err := conn.Get(znode)
+	if err != nil {
+		ctxLog = ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		})
+	}
+	switch err {
+	case nil:
+		ctxLog.Debug("Terraform lock retrieved")
+		return data, nil
+	case zk.ErrNoNode:
+		ctxLog.Error("Terraform lock does not exist")
+		return data, backend.ErrNotExist
+	default:
+		ctxLog.Error("Terraform lock cannot be retrieved")
+		return data, backend.ErrRead
+	}
+}
+
+func (store *Store) Lock(ctx context.Context, name string, lockinfo []byte) (alreadyLocked bool, newlockinfo []byte, err error) {
+	znode := store.lockPath(name)
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"znode": znode,
+	})
+	ctxLog.Debug("Lock znode state")
+
+	if err := ctx.Err(); err != nil {
+		return false, []byte{}, err
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		ctxLog.Error("No active zk session")
+		return false, []byte{}, backend.ErrConn
+	}
+
+	exists, _, err := conn.Exists(znode)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot check znode's existance")
+		return false, []byte{}, backend.ErrRead
+	}
+
+	if exists {
+		existingLock, _, err := conn.Get(znode)
+		if err != nil {
+			ctxLog.Error("Terraform lock state cannot be retrieved")
+			return false, []byte{}, backend.ErrRead
+		}
+		ctxLog.Info("Terraform lock exists")
+		return true, existingLock, nil
+	}
+
+	if err := ensureParents(conn, znode); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot create parent znodes")
+		return false, []byte{}, backend.ErrCreate
+	}
+
+	_, err = conn.Create(znode, lockinfo, int32(0), zk.WorldACL(zk.PermAll))
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot create znode")
+		return false, []byte{}, backend.ErrCreate
+	}
+	ctxLog.Info("Terraform lock created")
+	return false, lockinfo, nil
+}
+
+func (store *Store) Unlock(ctx context.Context, name string) error {
+	znode := store.lockPath(name)
+
+	ctxLog := store.logger.WithFields(logrus.Fields{
+		"znode": znode,
+	})
+	ctxLog.Debug("Unlock terraform state")
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		ctxLog.Error("No active zk session")
+		return backend.ErrConn
+	}
+
+	exists, stat, err := conn.Exists(znode)
+	if err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot check znode's existance")
+		return backend.ErrRead
+	}
+
+	if !exists {
+		ctxLog.Error("Terraform lockinfo does not exist")
+		return backend.ErrNotExist
+	}
+
+	ctxLog = ctxLog.WithFields(logrus.Fields{
+		"znode":        znode,
+		"stat_version": stat.Version,
+	})
+
+	ctxLog.Info("Delete terraform lockinfo")
+
+	if err := conn.Delete(znode, stat.Version); err != nil {
+		ctxLog.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot delete znode")
+		return backend.ErrDelete
+	}
+
+	ctxLog.Info("Terraform state unlocked")
+	return nil
+}
+
+// Tree returns every known workspace name grouped by project, for the "GET
+// /" listing endpoint. It refuses to walk the zk root when no
+// WithStatePrefix is configured, since that root is shared by the whole
+// ensemble (e.g. ZK's own "/zookeeper" znode) and is not specific to
+// Terraform state.
+func (store *Store) Tree(ctx context.Context) (map[string][]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if store.prefix == "" {
+		store.logger.Warn("Cannot list workspaces: no WithStatePrefix configured, refusing to enumerate the zk root")
+		return map[string][]string{}, nil
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		store.logger.Error("No active zk session")
+		return nil, backend.ErrConn
+	}
+
+	projects, _, err := conn.Children(store.prefix)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return map[string][]string{}, nil
+		}
+		store.logger.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Error("Cannot list projects")
+		return nil, backend.ErrRead
+	}
+
+	tree := make(map[string][]string, len(projects))
+	for _, project := range projects {
+		names, err := store.listProject(conn, project)
+		if err != nil {
+			return nil, err
+		}
+		tree[project] = names
+	}
+	return tree, nil
+}
+
+// ListProject returns the names of workspaces under project, for the "GET
+// /:project" listing endpoint.
+func (store *Store) ListProject(ctx context.Context, project string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := store.getConn()
+	if err != nil {
+		store.logger.Error("No active zk session")
+		return nil, backend.ErrConn
+	}
+
+	return store.listProject(conn, project)
+}
+
+func (store *Store) listProject(conn *zk.Conn, project string) ([]string, error) {
+	path := store.prefix + "/" + project
+
+	names, _, err := conn.Children(path)
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return []string{}, nil
+		}
+		store.logger.WithFields(logrus.Fields{
+			"project": project,
+			"reason":  err.Error(),
+		}).Error("Cannot list workspaces")
+		return nil, backend.ErrRead
+	}
+	return names, nil
+}
@@ -0,0 +1,27 @@
+package zk
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGrowBackoff(t *testing.T) {
+	cases := []struct {
+		name string
+		in   time.Duration
+		want time.Duration
+	}{
+		{name: "doubles", in: time.Second, want: 2 * time.Second},
+		{name: "doubles again", in: 4 * time.Second, want: 8 * time.Second},
+		{name: "caps at max", in: 20 * time.Second, want: maxReconnectBackoff},
+		{name: "stays capped once at max", in: maxReconnectBackoff, want: maxReconnectBackoff},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := growBackoff(tc.in); got != tc.want {
+				t.Fatalf("growBackoff(%s) = %s, want %s", tc.in, got, tc.want)
+			}
+		})
+	}
+}
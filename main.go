@@ -1,41 +1,106 @@
 package main
 
 import (
-	"net/http"
 	"os"
 	"strings"
+	"time"
 
-	"github.com/goji/httpauth"
 	"github.com/sirupsen/logrus"
-	"goji.io"
-	"goji.io/pat"
+
+	"github.com/jaxi/tf-zk-backend/backend/local"
+	"github.com/jaxi/tf-zk-backend/backend/postgres"
 )
 
-func main() {
-	zksStr := os.Getenv("ZKS")
-	zksList := []string{}
-	for _, zk := range strings.Split(zksStr, ",") {
-		if zk != "" {
-			zksList = append(zksList, zk)
+// warnIfEncryptionKeyIgnored logs a warning when STATE_ENCRYPTION_KEY is set
+// but the selected backend (unlike zk) has no at-rest encryption of its own,
+// so an operator switching BACKEND does not silently lose the guarantee.
+func warnIfEncryptionKeyIgnored(logger *logrus.Logger, backend string) {
+	if os.Getenv("STATE_ENCRYPTION_KEY") != "" {
+		logger.WithFields(logrus.Fields{
+			"backend": backend,
+		}).Warn("STATE_ENCRYPTION_KEY is set but only the zk backend supports state encryption; state will be written in cleartext")
+	}
+}
+
+// backendOptions inspects BACKEND (and its related env vars) and returns the
+// Options needed to wire up the requested implementation. Defaults to zk.
+func backendOptions(logger *logrus.Logger) []Option {
+	switch kind := os.Getenv("BACKEND"); kind {
+	case "", "zk":
+		zksStr := os.Getenv("ZKS")
+		zksList := []string{}
+		for _, addr := range strings.Split(zksStr, ",") {
+			if addr != "" {
+				zksList = append(zksList, addr)
+			}
+		}
+
+		zks := make([]string, len(zksList))
+		copy(zks, zksList)
+
+		opts := []Option{WithZookeeper(zks, time.Second)}
+
+		if key := os.Getenv("STATE_ENCRYPTION_KEY"); key != "" {
+			if len(key) != 32 {
+				logger.Fatal("STATE_ENCRYPTION_KEY must be 32 bytes")
+			}
+			opts = append(opts, WithEncryptionKey([]byte(key)))
 		}
+
+		if prefix := os.Getenv("STATE_PREFIX"); prefix != "" {
+			opts = append(opts, WithStatePrefix(prefix))
+		}
+
+		return opts
+	case "local":
+		warnIfEncryptionKeyIgnored(logger, "local")
+
+		dir := os.Getenv("LOCAL_STATE_DIR")
+		if dir == "" {
+			dir = "./terraform-state"
+		}
+
+		store, err := local.New(dir, logger)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Fatal("Cannot initialize local backend")
+		}
+		return []Option{WithBackend(store), WithLocker(store)}
+	case "postgres":
+		warnIfEncryptionKeyIgnored(logger, "postgres")
+
+		store, err := postgres.New(os.Getenv("POSTGRES_DSN"), logger)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Fatal("Cannot initialize postgres backend")
+		}
+		return []Option{WithBackend(store), WithLocker(store)}
+	default:
+		logger.Fatalf("Unknown BACKEND %q, expected zk, local or postgres", kind)
+		return nil
 	}
+}
 
-	zks := make([]string, len(zksList))
-	copy(zks, zksList)
+func main() {
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetOutput(os.Stdout)
+	logger.SetLevel(logrus.DebugLevel)
 
-	server := NewServer(zks, logrus.New(), func(log *logrus.Logger) {
-		log.SetFormatter(&logrus.JSONFormatter{})
-		log.SetOutput(os.Stdout)
-		log.SetLevel(logrus.DebugLevel)
-	})
+	opts := append([]Option{WithLogger(logger)}, backendOptions(logger)...)
 
-	mux := goji.NewMux()
-	mux.Use(httpauth.SimpleBasicAuth("admin", "password"))
+	if os.Getenv("LEGACY_FLAT_WORKSPACES") != "" {
+		opts = append(opts, WithLegacyFlatWorkspaces())
+	}
 
-	mux.HandleFunc(pat.Get("/:name"), server.Get)
-	mux.HandleFunc(pat.Post("/:name"), server.Update)
-	mux.HandleFunc(pat.Delete("/:name"), server.Delete)
-	mux.HandleFunc(pat.NewWithMethods("/:name", "LOCK"), server.Lock)
-	mux.HandleFunc(pat.NewWithMethods("/:name", "UNLOCK"), server.Unlock)
-	http.ListenAndServe("localhost:8000", mux)
+	server := NewServer(opts...)
+	defer server.Close()
+
+	if err := server.ListenAndServe(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"reason": err.Error(),
+		}).Fatal("Server exited")
+	}
 }
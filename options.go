@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/goji/httpauth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"goji.io"
+	"goji.io/pat"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+	"github.com/jaxi/tf-zk-backend/backend/zk"
+)
+
+// Server serves the Terraform HTTP state backend protocol over a Backend
+// and Locker pair.
+type Server struct {
+	backend backend.Backend
+	locker  backend.Locker
+	logger  *logrus.Logger
+
+	listenAddr    string
+	basicAuthUser string
+	basicAuthPass string
+	tlsCert       string
+	tlsKey        string
+	metrics       *prometheus.Registry
+
+	zkHosts          []string
+	zkSessionTimeout time.Duration
+	zkEncryptionKey  []byte
+	zkStatePrefix    string
+
+	legacyFlatWorkspaces bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Option configures a Server created by NewServer.
+type Option func(*Server)
+
+// WithZookeeper configures the server to store state and locks in the given
+// Zookeeper ensemble. It is ignored if WithBackend/WithLocker are also
+// given.
+func WithZookeeper(hosts []string, sessionTimeout time.Duration) Option {
+	return func(s *Server) {
+		s.zkHosts = hosts
+		s.zkSessionTimeout = sessionTimeout
+	}
+}
+
+// WithLogger sets the logger the server reports requests and backend errors
+// to. Defaults to a logrus.Logger with logrus defaults.
+func WithLogger(logger *logrus.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithBackend sets the Backend used to store Terraform state, overriding
+// WithZookeeper.
+func WithBackend(b backend.Backend) Option {
+	return func(s *Server) {
+		s.backend = b
+	}
+}
+
+// WithLocker sets the Locker used to guard Terraform state, overriding
+// WithZookeeper.
+func WithLocker(l backend.Locker) Option {
+	return func(s *Server) {
+		s.locker = l
+	}
+}
+
+// WithEncryptionKey enables envelope encryption of Terraform state before it
+// is written to Zookeeper, using the given 32-byte AES-256 key. It has no
+// effect unless WithZookeeper is also used.
+func WithEncryptionKey(key []byte) Option {
+	return func(s *Server) {
+		s.zkEncryptionKey = key
+	}
+}
+
+// WithStatePrefix sets the znode path under which every workspace is
+// stored, as "<prefix>/<project>/<name>". Defaults to "", i.e. workspaces
+// are stored directly under the zk root. It has no effect unless
+// WithZookeeper is also used.
+func WithStatePrefix(prefix string) Option {
+	return func(s *Server) {
+		s.zkStatePrefix = prefix
+	}
+}
+
+// WithLegacyFlatWorkspaces serves the pre-hierarchical "/:name" address
+// ("http://host:8000/myworkspace") alongside the hierarchical
+// "/:project/:name" routes, so Terraform configurations written against the
+// old address keep working. Off by default: a flat write to a name that is
+// already in use as a project (i.e. has nested workspaces under it) is
+// refused rather than silently clobbering them.
+func WithLegacyFlatWorkspaces() Option {
+	return func(s *Server) {
+		s.legacyFlatWorkspaces = true
+	}
+}
+
+// WithBasicAuth sets the HTTP basic auth credentials Terraform must present.
+// Defaults to "admin"/"password".
+func WithBasicAuth(user, pass string) Option {
+	return func(s *Server) {
+		s.basicAuthUser = user
+		s.basicAuthPass = pass
+	}
+}
+
+// WithListenAddr sets the address ListenAndServe binds to. Defaults to
+// "localhost:8000".
+func WithListenAddr(addr string) Option {
+	return func(s *Server) {
+		s.listenAddr = addr
+	}
+}
+
+// WithTLS enables HTTPS using the given certificate and key files. Plain
+// HTTP is served if this option is not given.
+func WithTLS(cert, key string) Option {
+	return func(s *Server) {
+		s.tlsCert = cert
+		s.tlsKey = key
+	}
+}
+
+// WithMetrics exposes Prometheus metrics from registry on /metrics. Metrics
+// are not exposed if this option is not given.
+func WithMetrics(registry *prometheus.Registry) Option {
+	return func(s *Server) {
+		s.metrics = registry
+	}
+}
+
+// NewServer builds a Server from opts, applying sane defaults for anything
+// not explicitly configured. If a Zookeeper backend was requested, its
+// session is established here and torn down by Close.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		logger:           logrus.New(),
+		listenAddr:       "localhost:8000",
+		basicAuthUser:    "admin",
+		basicAuthPass:    "password",
+		zkSessionTimeout: time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if s.backend == nil && s.locker == nil && s.zkHosts != nil {
+		zkOpts := []zk.Option{
+			zk.WithHosts(s.zkHosts),
+			zk.WithSessionTimeout(s.zkSessionTimeout),
+			zk.WithLogger(s.logger),
+			zk.WithStatePrefix(s.zkStatePrefix),
+		}
+		if len(s.zkEncryptionKey) > 0 {
+			zkOpts = append(zkOpts, zk.WithEncryptionKey(s.zkEncryptionKey))
+		}
+
+		store := zk.New(zkOpts...)
+		if err := store.Connect(s.ctx); err != nil {
+			s.logger.WithFields(logrus.Fields{
+				"reason": err.Error(),
+			}).Error("Cannot establish initial zk session")
+		}
+		s.backend = store
+		s.locker = store
+	}
+
+	return s
+}
+
+// Close stops the server's background goroutines (such as the Zookeeper
+// session watcher), cancelling the context handed to any in-flight request,
+// and closes the backend's connection if it holds one.
+func (s *Server) Close() {
+	s.cancel()
+	if closer, ok := s.backend.(backend.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Mux builds the goji router serving the Terraform HTTP state backend
+// protocol, wrapped in basic auth.
+func (s *Server) Mux() *goji.Mux {
+	mux := goji.NewMux()
+	mux.Use(httpauth.SimpleBasicAuth(s.basicAuthUser, s.basicAuthPass))
+
+	mux.HandleFunc(pat.Get("/healthz"), s.Healthz)
+	if s.metrics != nil {
+		mux.Handle(pat.Get("/metrics"), promhttp.HandlerFor(s.metrics, promhttp.HandlerOpts{}))
+	}
+
+	mux.HandleFunc(pat.Get("/"), s.ListStates)
+
+	if s.legacyFlatWorkspaces {
+		mux.HandleFunc(pat.Get("/:name"), s.GetOrListProject)
+		mux.HandleFunc(pat.Post("/:name"), s.UpdateLegacy)
+		mux.HandleFunc(pat.Delete("/:name"), s.DeleteLegacy)
+		mux.HandleFunc(pat.NewWithMethods("/:name", "LOCK"), s.LockLegacy)
+		mux.HandleFunc(pat.NewWithMethods("/:name", "UNLOCK"), s.UnlockLegacy)
+	}
+
+	mux.HandleFunc(pat.Get("/:project/:name"), s.Get)
+	mux.HandleFunc(pat.Post("/:project/:name"), s.Update)
+	mux.HandleFunc(pat.Delete("/:project/:name"), s.Delete)
+	mux.HandleFunc(pat.NewWithMethods("/:project/:name", "LOCK"), s.Lock)
+	mux.HandleFunc(pat.NewWithMethods("/:project/:name", "UNLOCK"), s.Unlock)
+
+	return mux
+}
+
+// ListenAndServe binds to the configured listen address and serves the
+// Terraform HTTP state backend protocol until the process exits or an error
+// occurs. It serves HTTPS when WithTLS was given, plain HTTP otherwise.
+func (s *Server) ListenAndServe() error {
+	srv := &http.Server{
+		Addr:    s.listenAddr,
+		Handler: s.Mux(),
+		// Derive every request's context from s.ctx so Close cancels
+		// in-flight requests.
+		BaseContext: func(net.Listener) context.Context { return s.ctx },
+	}
+
+	if s.tlsCert != "" {
+		return srv.ListenAndServeTLS(s.tlsCert, s.tlsKey)
+	}
+	return srv.ListenAndServe()
+}
@@ -2,64 +2,106 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 
 	"github.com/sirupsen/logrus"
 	"goji.io/pat"
+
+	"github.com/jaxi/tf-zk-backend/backend"
 )
 
-type Server struct {
-	store *StateStore
+// workspaceName combines the :project and :name route parameters into the
+// single workspace identifier Backend/Locker implementations key state on.
+func workspaceName(r *http.Request) string {
+	return pat.Param(r, "project") + "/" + pat.Param(r, "name")
 }
 
-func NewServer(Zks []string, logger *logrus.Logger, logSetup func(log *logrus.Logger)) *Server {
-	logSetup(logger)
-
-	return &Server{
-		store: &StateStore{
-			Zks:    Zks,
-			logger: logger,
-		},
-	}
+func (s *Server) Get(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	s.getState(w, r, workspaceName(r))
 }
 
-func (s *Server) Get(w http.ResponseWriter, r *http.Request) {
+// GetOrListProject serves the legacy "/:name" address: it tries :name as a
+// flat workspace first, falling back to listing it as a project if no flat
+// state exists there.
+func (s *Server) GetOrListProject(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	state, err := s.store.Get(pat.Param(r, "name"))
+	name := pat.Param(r, "name")
 
+	state, err := s.backend.Get(r.Context(), name)
 	switch err {
-	case ErrConn, ErrRead:
+	case nil:
+		if len(state) > 0 {
+			writeState(w, state)
+			return
+		}
+		// An errorless but empty read means :name is the empty placeholder
+		// znode ensureParents creates as a parent for nested workspaces (see
+		// backend/zk/zk.go), not a real flat state; fall through to listing
+		// it as a project instead.
+	case backend.ErrConn, backend.ErrRead:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, err.Error())
-	case ErrNotExist:
+		return
+	}
+
+	s.listProject(w, r, name)
+}
+
+func (s *Server) getState(w http.ResponseWriter, r *http.Request, name string) {
+	state, err := s.backend.Get(r.Context(), name)
+
+	switch err {
+	case backend.ErrConn, backend.ErrRead:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, err.Error())
+	case backend.ErrNotExist:
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, err.Error())
 	case nil:
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(state)
+		writeState(w, state)
 	}
 }
 
+// writeState writes state as a 200 response with the JSON content type set
+// before the status line, so it actually reaches the client.
+func writeState(w http.ResponseWriter, state []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(state)
+}
+
 func (s *Server) Update(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	s.updateState(w, r, workspaceName(r))
+}
 
-	name := pat.Param(r, "name")
+// UpdateLegacy serves "POST /:name", the legacy flat address.
+func (s *Server) UpdateLegacy(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	s.updateState(w, r, pat.Param(r, "name"))
+}
 
+func (s *Server) updateState(w http.ResponseWriter, r *http.Request, name string) {
 	buf := new(bytes.Buffer)
 	if _, err := io.Copy(buf, r.Body); err != nil {
-		s.store.logger.Error("Cannot read request body")
+		s.logger.Error("Cannot read request body")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	state := buf.Bytes()
 
-	err := s.store.Update(name, state)
+	if !s.checkLockID(r, w, name, r.URL.Query().Get("ID")) {
+		return
+	}
+
+	err := s.backend.Update(r.Context(), name, state)
 	switch err {
-	case ErrConn, ErrRead, ErrCreate, ErrWrite:
+	case backend.ErrConn, backend.ErrRead, backend.ErrCreate, backend.ErrWrite:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, err.Error())
 	case nil:
@@ -69,13 +111,26 @@ func (s *Server) Update(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) Delete(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	s.deleteState(w, r, workspaceName(r))
+}
+
+// DeleteLegacy serves "DELETE /:name", the legacy flat address.
+func (s *Server) DeleteLegacy(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	s.deleteState(w, r, pat.Param(r, "name"))
+}
+
+func (s *Server) deleteState(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.checkLockID(r, w, name, r.URL.Query().Get("ID")) {
+		return
+	}
 
-	err := s.store.Delete(pat.Param(r, "name"))
+	err := s.backend.Delete(r.Context(), name)
 	switch err {
-	case ErrConn, ErrNotExist, ErrDelete:
+	case backend.ErrConn, backend.ErrNotExist, backend.ErrDelete:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, err.Error())
-	case ErrNotExist:
+	case backend.ErrNotExist:
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, err.Error())
 	case nil:
@@ -83,23 +138,71 @@ func (s *Server) Delete(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// checkLockID verifies that the lock ID Terraform's HTTP backend supplies via
+// the ?ID= query parameter on writes matches the lock currently held for
+// name. On a mismatch it writes a 423 response with the current lock body
+// (mirroring Terraform's LockError) and returns false so the caller can
+// return immediately. An empty id skips the check, since not every state
+// operation is guarded by a lock.
+func (s *Server) checkLockID(r *http.Request, w http.ResponseWriter, name, id string) bool {
+	if id == "" {
+		return true
+	}
+
+	currentLock, err := s.locker.GetLock(r.Context(), name)
+	if err != nil && err != backend.ErrNotExist {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, err.Error())
+		return false
+	}
+
+	var info backend.LockInfo
+	if err == nil {
+		if jsonErr := json.Unmarshal(currentLock, &info); jsonErr != nil {
+			s.logger.WithFields(logrus.Fields{
+				"name":   name,
+				"reason": jsonErr.Error(),
+			}).Error("Cannot decode lock info")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, jsonErr.Error())
+			return false
+		}
+	}
+
+	if info.ID == id {
+		return true
+	}
+
+	w.WriteHeader(http.StatusLocked)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(currentLock)
+	return false
+}
+
 func (s *Server) Lock(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	s.lockState(w, r, workspaceName(r))
+}
 
-	name := pat.Param(r, "name")
+// LockLegacy serves "LOCK /:name", the legacy flat address.
+func (s *Server) LockLegacy(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	s.lockState(w, r, pat.Param(r, "name"))
+}
 
+func (s *Server) lockState(w http.ResponseWriter, r *http.Request, name string) {
 	buf := new(bytes.Buffer)
 	if _, err := io.Copy(buf, r.Body); err != nil {
-		s.store.logger.Error("Cannot read request body")
+		s.logger.Error("Cannot read request body")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	lockinfo := buf.Bytes()
 
-	alreadyLocked, returnedLockinfo, err := s.store.Lock(name, lockinfo)
+	alreadyLocked, returnedLockinfo, err := s.locker.Lock(r.Context(), name, lockinfo)
 
 	switch err {
-	case ErrConn, ErrRead, ErrCreate:
+	case backend.ErrConn, backend.ErrRead, backend.ErrCreate:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, err.Error())
 	case nil:
@@ -115,16 +218,85 @@ func (s *Server) Lock(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) Unlock(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
+	s.unlockState(w, r, workspaceName(r))
+}
+
+// UnlockLegacy serves "UNLOCK /:name", the legacy flat address.
+func (s *Server) UnlockLegacy(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	s.unlockState(w, r, pat.Param(r, "name"))
+}
 
-	err := s.store.Unlock(pat.Param(r, "name"))
+func (s *Server) unlockState(w http.ResponseWriter, r *http.Request, name string) {
+	err := s.locker.Unlock(r.Context(), name)
 	switch err {
-	case ErrConn, ErrNotExist, ErrDelete:
+	case backend.ErrConn, backend.ErrNotExist, backend.ErrDelete:
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, err.Error())
-	case ErrNotExist:
+	case backend.ErrNotExist:
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, err.Error())
 	case nil:
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// Healthz reports 503 while the backend has no usable connection (e.g. the
+// Zookeeper session is not yet established), and 200 otherwise. Backends
+// that do not hold a persistent connection always report healthy.
+func (s *Server) Healthz(w http.ResponseWriter, r *http.Request) {
+	pinger, ok := s.backend.(backend.Pinger)
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := pinger.Ping(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ListStates serves the known workspaces grouped by project. Backends that
+// do not organize state hierarchically do not implement backend.Lister, so
+// this reports 404.
+func (s *Server) ListStates(w http.ResponseWriter, r *http.Request) {
+	lister, ok := s.backend.(backend.Lister)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tree, err := lister.Tree(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tree)
+}
+
+// listProject writes the workspace names known under project as the JSON
+// response body, or 404/500 as appropriate.
+func (s *Server) listProject(w http.ResponseWriter, r *http.Request, project string) {
+	lister, ok := s.backend.(backend.Lister)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	names, err := lister.ListProject(r.Context(), project)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
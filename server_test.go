@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/jaxi/tf-zk-backend/backend"
+)
+
+// fakeLocker is a backend.Locker stub that returns canned GetLock results,
+// for exercising checkLockID without a real backend.
+type fakeLocker struct {
+	lockinfo []byte
+	err      error
+}
+
+func (f *fakeLocker) Lock(ctx context.Context, name string, lockinfo []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+
+func (f *fakeLocker) Unlock(ctx context.Context, name string) error { return nil }
+
+func (f *fakeLocker) GetLock(ctx context.Context, name string) ([]byte, error) {
+	return f.lockinfo, f.err
+}
+
+func marshalLockInfo(t *testing.T, id string) []byte {
+	t.Helper()
+	data, err := json.Marshal(backend.LockInfo{ID: id})
+	if err != nil {
+		t.Fatalf("marshal lock info: %v", err)
+	}
+	return data
+}
+
+func TestCheckLockID(t *testing.T) {
+	cases := []struct {
+		name       string
+		lockinfo   []byte
+		lockErr    error
+		id         string
+		wantOK     bool
+		wantStatus int
+	}{
+		{
+			name:   "empty id skips the check",
+			id:     "",
+			wantOK: true,
+		},
+		{
+			name:     "id matches the held lock",
+			lockinfo: marshalLockInfo(t, "abc"),
+			id:       "abc",
+			wantOK:   true,
+		},
+		{
+			name:       "id does not match the held lock",
+			lockinfo:   marshalLockInfo(t, "abc"),
+			id:         "xyz",
+			wantOK:     false,
+			wantStatus: http.StatusLocked,
+		},
+		{
+			name:       "no lock is held but an id was supplied",
+			lockErr:    backend.ErrNotExist,
+			id:         "abc",
+			wantOK:     false,
+			wantStatus: http.StatusLocked,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				locker: &fakeLocker{lockinfo: tc.lockinfo, err: tc.lockErr},
+				logger: logrus.New(),
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/proj/name", nil)
+
+			ok := s.checkLockID(r, w, "proj/name", tc.id)
+			if ok != tc.wantOK {
+				t.Fatalf("checkLockID() = %v, want %v", ok, tc.wantOK)
+			}
+			if !ok && w.Code != tc.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}